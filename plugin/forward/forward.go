@@ -0,0 +1,16 @@
+package forward
+
+import "crypto/tls"
+
+// Forward is a set of upstream proxies reachable through this plugin's persistent
+// connection transports, as configured by a single forward Corefile stanza.
+type Forward struct {
+	from      string
+	proxies   []*transport
+	tlsConfig *tls.Config
+}
+
+// New returns an empty, unconfigured Forward.
+func New() *Forward {
+	return &Forward{tlsConfig: new(tls.Config)}
+}
@@ -1,46 +1,183 @@
 package forward
 
 import (
+	"container/list"
+	"context"
 	"crypto/tls"
+	"errors"
 	"math/rand"
 	"net"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// errDialBackoff is returned by Dial when an upstream proto is in its backoff cool-down
+// period, so forward can fail over to the next proxy without touching the socket.
+var errDialBackoff = errors.New("forward: dial skipped, upstream is in backoff cool-down")
+
 // a persistConn hold the dns.Conn and the last used time.
 type persistConn struct {
 	c    *dns.Conn
 	used time.Time
 }
 
+// retConn is what connManager answers a dial request with: the cached conn (nil on a
+// cache miss) along with the time it was last used, so Dial can decide whether to probe it
+// without connManager itself blocking on a probe.
+type retConn struct {
+	conn *dns.Conn
+	used time.Time
+}
+
 // transport hold the persistent cache.
 type transport struct {
-	conns     map[string]map[int64]*persistConn //  Buckets for udp, tcp and tcp-tls, then (random) numbers -> *persistConn
-	expire    time.Duration                     // After this duration a connection is expired.
+	conns     map[string]*list.List // Lists for udp, tcp and tcp-tls, MRU at the front, LRU at the back.
+	expire    time.Duration         // After this duration a connection is expired.
 	addr      string
 	tlsConfig *tls.Config
 
-	dial  chan string
-	yield chan *dns.Conn
-	ret   chan *dns.Conn
-	stop  chan bool
+	maxIdleConns         int // Global cap on idle conns across udp/tcp/tcp-tls, 0 means no limit.
+	maxIdleConnsPerProto int // Cap on idle conns for a single proto, 0 means no limit.
+
+	dialCoalesce bool   // Collapse concurrent dials for the same proto into a single dial.
+	coalesceHits uint64 // Number of Dial calls that rode on another goroutine's in-flight dial.
+
+	backoffBase    time.Duration // Base of the backoff delay, doubled per consecutive failure (base*2 after the first). Defaults to defaultBackoffBase.
+	backoffCap     time.Duration // Upper bound on the backoff delay. Defaults to defaultBackoffCap.
+	backoffSkipped uint64        // Number of Dial calls skipped because a proto was in cool-down.
+
+	dialOpts dialOptions // Socket options applied to every outbound dial.
+
+	probeAfter time.Duration         // Probe a cached conn older than this before handing it out. 0 probes every cached conn.
+	probe      func(*dns.Conn) error // Health-probe run against a cached conn older than probeAfter.
+
+	dial          chan string
+	yield         chan *dns.Conn
+	ret           chan retConn
+	coalesceJoin  chan coalesceJoin
+	coalesceDone  chan string
+	backoffCheck  chan backoffCheck
+	backoffReport chan backoffReport
+	stop          chan bool
+}
+
+// dialOptions holds the socket-level settings applied to transport's outbound dials,
+// built from the TransportOption values passed to newTransport.
+type dialOptions struct {
+	keepAlive time.Duration
+	control   func(network, address string, c syscall.RawConn) error
+}
+
+// TransportOption configures the sockets transport dials, e.g. to enable SO_REUSEPORT,
+// tune TCP keepalive, or set a firewall mark for policy routing.
+type TransportOption func(*dialOptions)
+
+// WithKeepAlive sets the TCP keepalive period used for tcp and tcp-tls dials. The zero
+// value keeps the platform's default keepalive behavior.
+func WithKeepAlive(d time.Duration) TransportOption {
+	return func(o *dialOptions) { o.keepAlive = d }
+}
+
+// WithReusePort sets SO_REUSEPORT on outbound sockets, letting multiple transports share a
+// source port. Unsupported platforms return an error on Dial.
+func WithReusePort() TransportOption {
+	return func(o *dialOptions) { o.control = chainControl(o.control, reusePortControl) }
+}
+
+// WithSocketMark sets SO_MARK to mark on outbound sockets, for use with policy routing
+// (e.g. a Mullvad-style split-tunnel setup). Unsupported platforms return an error on Dial.
+func WithSocketMark(mark int) TransportOption {
+	return func(o *dialOptions) { o.control = chainControl(o.control, markControl(mark)) }
 }
 
-func newTransport(addr string, tlsConfig *tls.Config) *transport {
+// WithControl sets a raw socket control function, as used by net.Dialer.Control, for
+// advanced cases such as attaching an eBPF filter. It composes with any other option that
+// also sets a control function; all of them run before the dial proceeds.
+func WithControl(fn func(network, address string, c syscall.RawConn) error) TransportOption {
+	return func(o *dialOptions) { o.control = chainControl(o.control, fn) }
+}
+
+// chainControl composes two net.Dialer.Control functions, running a then b and stopping at
+// the first error. Either may be nil.
+func chainControl(a, b func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := a(network, address, c); err != nil {
+			return err
+		}
+		return b(network, address, c)
+	}
+}
+
+// backoffState tracks consecutive dial failures for a proto so Dial can skip hammering an
+// upstream that is currently unreachable.
+type backoffState struct {
+	attempts              int
+	coolDownIntervalStart time.Time
+	nextDialAt            time.Time
+}
+
+// backoffCheck is sent by Dial before attempting a network dial, to ask whether proto is
+// currently in its cool-down period.
+type backoffCheck struct {
+	proto string
+	resp  chan bool
+}
+
+// backoffReport is sent by Dial after a network dial attempt, so connManager can reset or
+// advance the backoff state for proto.
+type backoffReport struct {
+	proto string
+	ok    bool
+}
+
+// coalesceJoin is sent by Dial on a cache miss to ask connManager whether a dial for proto
+// is already in flight.
+type coalesceJoin struct {
+	proto string
+	resp  chan coalesceResp
+}
+
+// coalesceResp answers a coalesceJoin. If lead is true the caller is the first one in and
+// must perform the dial itself. Otherwise the caller should block on wait until the leader's
+// dial has completed before trying again.
+type coalesceResp struct {
+	lead bool
+	wait chan struct{}
+}
+
+func newTransport(addr string, tlsConfig *tls.Config, opts ...TransportOption) *transport {
+	var o dialOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	t := &transport{
-		conns:  make(map[string]map[int64]*persistConn),
-		expire: defaultExpire,
-		addr:   addr,
-		dial:   make(chan string),
-		yield:  make(chan *dns.Conn),
-		ret:    make(chan *dns.Conn),
-		stop:   make(chan bool),
-	}
-	t.conns["udp"] = make(map[int64]*persistConn)
-	t.conns["tcp"] = make(map[int64]*persistConn)
-	t.conns["tcp-tls"] = make(map[int64]*persistConn)
+		conns:         make(map[string]*list.List),
+		expire:        defaultExpire,
+		addr:          addr,
+		dialOpts:      o,
+		probeAfter:    defaultProbeAfter,
+		dial:          make(chan string),
+		yield:         make(chan *dns.Conn),
+		ret:           make(chan retConn),
+		coalesceJoin:  make(chan coalesceJoin),
+		coalesceDone:  make(chan string),
+		backoffCheck:  make(chan backoffCheck),
+		backoffReport: make(chan backoffReport),
+		stop:          make(chan bool),
+	}
+	t.conns["udp"] = list.New()
+	t.conns["tcp"] = list.New()
+	t.conns["tcp-tls"] = list.New()
 
 	go func() { t.connManager() }()
 	return t
@@ -48,47 +185,94 @@ func newTransport(addr string, tlsConfig *tls.Config) *transport {
 
 // connManagers manages the persistent connection cache for UDP and TCP.
 func (t *transport) connManager() {
+	// dialing tracks, per proto, the goroutines waiting on an in-flight dial started by
+	// some other caller. A present-but-empty slice means a dial is in flight with no
+	// followers yet.
+	dialing := make(map[string][]chan struct{})
+
+	// backoff tracks consecutive dial failures per proto.
+	backoff := make(map[string]*backoffState)
+	cleanup := time.NewTicker(dialCoolDownDelay)
+	defer cleanup.Stop()
 
 Wait:
 	for {
 		select {
 		case proto := <-t.dial:
-			// Yes O(n), shouldn't put millions in here. We walk all connection until we find the first
-			// one that is usuable.
-
+			// Walk the list from the front (most recently used) so Dial returns the freshest
+			// usable connection, closing and dropping any expired entries along the way.
 			ma := t.conns[proto]
-			for k, pc := range ma {
-				if time.Since(pc.used) < t.expire {
-					// Found one, remove from pool and return this conn.
-					delete(ma, k)
-					t.ret <- pc.c
-					continue Wait
+			e := ma.Front()
+			for e != nil {
+				next := e.Next()
+				pc := e.Value.(*persistConn)
+				if time.Since(pc.used) >= t.expire {
+					// This conn has expired. Close it.
+					pc.c.Close()
+					ma.Remove(e)
+					e = next
+					continue
 				}
-				// This conn has expired. Close it.
-				pc.c.Close()
-				delete(ma, k)
+				ma.Remove(e)
+				t.ret <- retConn{pc.c, pc.used}
+				continue Wait
 			}
 
-			t.ret <- nil
+			t.ret <- retConn{}
 
 		case conn := <-t.yield:
 
 			//			SocketGauge.WithLabelValues(t.addr).Set(float64(t.len() + 1))
 
-			key := rand.Int63()
+			proto := t.proto(conn)
+			ma := t.conns[proto]
+			ma.PushFront(&persistConn{conn, time.Now()})
+			t.evict(proto)
 
-			// no proto here, infer from config and conn
-			if _, ok := conn.Conn.(*net.UDPConn); ok {
-				t.conns["udp"][key] = &persistConn{conn, time.Now()}
+		case j := <-t.coalesceJoin:
+			waiters, inFlight := dialing[j.proto]
+			if !inFlight {
+				dialing[j.proto] = nil
+				j.resp <- coalesceResp{lead: true}
 				continue Wait
 			}
+			w := make(chan struct{})
+			dialing[j.proto] = append(waiters, w)
+			atomic.AddUint64(&t.coalesceHits, 1)
+			j.resp <- coalesceResp{wait: w}
 
-			if t.tlsConfig == nil {
-				t.conns["tcp"][key] = &persistConn{conn, time.Now()}
+		case proto := <-t.coalesceDone:
+			for _, w := range dialing[proto] {
+				close(w)
+			}
+			delete(dialing, proto)
+
+		case chk := <-t.backoffCheck:
+			st := backoff[chk.proto]
+			chk.resp <- st == nil || !time.Now().Before(st.nextDialAt)
+
+		case rep := <-t.backoffReport:
+			if rep.ok {
+				delete(backoff, rep.proto)
 				continue Wait
 			}
+			st := backoff[rep.proto]
+			if st == nil {
+				st = &backoffState{coolDownIntervalStart: time.Now()}
+				backoff[rep.proto] = st
+			}
+			st.attempts++
+			st.nextDialAt = time.Now().Add(t.backoffDelay(st.attempts))
 
-			t.conns["tcp-tls"][key] = &persistConn{conn, time.Now()}
+		case <-cleanup.C:
+			// Bound the backoff map in case many distinct protos flap; an entry is only
+			// dropped once its cool-down has actually elapsed.
+			now := time.Now()
+			for proto, st := range backoff {
+				if now.Sub(st.coolDownIntervalStart) > dialCoolDownDelay && !now.Before(st.nextDialAt) {
+					delete(backoff, proto)
+				}
+			}
 
 		case <-t.stop:
 			close(t.ret)
@@ -97,6 +281,73 @@ Wait:
 	}
 }
 
+// proto returns the protocol bucket conn belongs to.
+func (t *transport) proto(conn *dns.Conn) string {
+	if _, ok := conn.Conn.(*net.UDPConn); ok {
+		return "udp"
+	}
+	if t.tlsConfig == nil {
+		return "tcp"
+	}
+	return "tcp-tls"
+}
+
+// evict enforces maxIdleConnsPerProto on proto and maxIdleConns globally, closing and
+// dropping the least recently used connections (from the back of the lists) as needed.
+func (t *transport) evict(proto string) {
+	ma := t.conns[proto]
+	for t.maxIdleConnsPerProto > 0 && ma.Len() > t.maxIdleConnsPerProto {
+		t.removeOldest(ma)
+	}
+
+	for t.maxIdleConns > 0 && t.idleLen() > t.maxIdleConns {
+		if !t.removeOldest(t.oldest()) {
+			break
+		}
+	}
+}
+
+// idleLen returns the total number of idle connections across all protocols.
+func (t *transport) idleLen() int {
+	n := 0
+	for _, ma := range t.conns {
+		n += ma.Len()
+	}
+	return n
+}
+
+// oldest returns the list holding the globally least recently used connection.
+func (t *transport) oldest() *list.List {
+	var oldest *list.List
+	var oldestUsed time.Time
+	for _, ma := range t.conns {
+		e := ma.Back()
+		if e == nil {
+			continue
+		}
+		used := e.Value.(*persistConn).used
+		if oldest == nil || used.Before(oldestUsed) {
+			oldest = ma
+			oldestUsed = used
+		}
+	}
+	return oldest
+}
+
+// removeOldest closes and removes the connection at the back of ma, reporting whether it did so.
+func (t *transport) removeOldest(ma *list.List) bool {
+	if ma == nil {
+		return false
+	}
+	e := ma.Back()
+	if e == nil {
+		return false
+	}
+	e.Value.(*persistConn).c.Close()
+	ma.Remove(e)
+	return true
+}
+
 // Dial dials the address configured in transport, potentially reusing a connection or creating a new one.
 func (t *transport) Dial(proto string) (*dns.Conn, bool, error) {
 	// If tls has been configured; use it.
@@ -104,21 +355,140 @@ func (t *transport) Dial(proto string) (*dns.Conn, bool, error) {
 		proto = "tcp-tls"
 	}
 
-	t.dial <- proto
-	c := <-t.ret
-
-	if c != nil {
+	if c := t.fromCache(proto); c != nil {
 		return c, true, nil
 	}
 
-	if proto == "tcp-tls" {
-		conn, err := dns.DialTimeoutWithTLS("tcp", t.addr, t.tlsConfig, dialTimeout)
+	if !t.backoffAllowed(proto) {
+		atomic.AddUint64(&t.backoffSkipped, 1)
+		return nil, false, errDialBackoff
+	}
+
+	if !t.dialCoalesce {
+		conn, err := t.dialNew(proto)
 		return conn, false, err
 	}
-	conn, err := dns.DialTimeout(proto, t.addr, dialTimeout)
+
+	resp := make(chan coalesceResp)
+	t.coalesceJoin <- coalesceJoin{proto: proto, resp: resp}
+	r := <-resp
+
+	if r.lead {
+		conn, err := t.dialNew(proto)
+		t.coalesceDone <- proto
+		return conn, false, err
+	}
+
+	// Wait for the leader's dial to finish, then check the pool again in case it Yielded
+	// its connection back, before dialing ourselves.
+	<-r.wait
+
+	if c := t.fromCache(proto); c != nil {
+		return c, true, nil
+	}
+	if !t.backoffAllowed(proto) {
+		atomic.AddUint64(&t.backoffSkipped, 1)
+		return nil, false, errDialBackoff
+	}
+	conn, err := t.dialNew(proto)
 	return conn, false, err
 }
 
+// fromCache asks connManager for a cached conn for proto and, if one is returned and is
+// older than probeAfter, probes it in the caller's own goroutine (never connManager's,
+// which must stay free to service other protos and callers). A conn that fails its probe
+// is closed and fromCache reports a miss, same as an empty pool.
+func (t *transport) fromCache(proto string) *dns.Conn {
+	for {
+		t.dial <- proto
+		rc := <-t.ret
+		if rc.conn == nil {
+			return nil
+		}
+
+		if t.probe != nil && time.Since(rc.used) >= t.probeAfter {
+			if err := t.probe(rc.conn); err != nil {
+				rc.conn.Close()
+				continue
+			}
+		}
+
+		return rc.conn
+	}
+}
+
+// backoffAllowed asks connManager whether proto may be dialed now, i.e. it isn't in its
+// backoff cool-down period.
+func (t *transport) backoffAllowed(proto string) bool {
+	resp := make(chan bool)
+	t.backoffCheck <- backoffCheck{proto: proto, resp: resp}
+	return <-resp
+}
+
+// dialNew opens a fresh connection for proto, without consulting the idle pool, and reports
+// the outcome to connManager so it can update the proto's backoff state.
+func (t *transport) dialNew(proto string) (*dns.Conn, error) {
+	conn, err := t.dial0(proto)
+	t.backoffReport <- backoffReport{proto: proto, ok: err == nil}
+	return conn, err
+}
+
+// dial0 performs the actual network dial for proto, using a net.Dialer/tls.Dialer built
+// from t.dialOpts instead of the package-level dns.DialTimeout helpers, so that socket
+// options such as keepalive, SO_REUSEPORT or SO_MARK apply to the outbound connection.
+func (t *transport) dial0(proto string) (*dns.Conn, error) {
+	d := net.Dialer{Timeout: dialTimeout, KeepAlive: t.dialOpts.keepAlive, Control: t.dialOpts.control}
+
+	if proto == "tcp-tls" {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		td := tls.Dialer{NetDialer: &d, Config: t.tlsConfig}
+		conn, err := td.DialContext(ctx, "tcp", t.addr)
+		if err != nil {
+			return nil, err
+		}
+		return &dns.Conn{Conn: conn}, nil
+	}
+
+	conn, err := d.Dial(proto, t.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// backoffDelay returns the delay before the next dial attempt after attempts consecutive
+// failures: base * 2^min(attempts, cap-exponent), clamped to backoffCap and jittered ±20%.
+func (t *transport) backoffDelay(attempts int) time.Duration {
+	base := t.backoffBase
+	if base <= 0 {
+		base = defaultBackoffBase
+	}
+	max := t.backoffCap
+	if max <= 0 {
+		max = defaultBackoffCap
+	}
+
+	exp := attempts
+	if exp > 10 {
+		exp = 10 // enough to blow past any sane cap; avoids overflow on the shift.
+	}
+	d := base * time.Duration(uint64(1)<<uint(exp))
+	if d <= 0 || d > max {
+		d = max
+	}
+
+	jitter := time.Duration(float64(d) * (rand.Float64()*0.4 - 0.2))
+	d += jitter
+	if d < 0 {
+		d = 0
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
 // Yield return the connection to transport for reuse.
 func (t *transport) Yield(c *dns.Conn) { t.yield <- c }
 
@@ -131,4 +501,85 @@ func (t *transport) SetExpire(expire time.Duration) { t.expire = expire }
 // SetTLSConfig sets the TLS config in transport.
 func (t *transport) SetTLSConfig(cfg *tls.Config) { t.tlsConfig = cfg }
 
-const defaultExpire = 10 * time.Second
+// SetDialOpts applies additional TransportOptions on top of whatever was passed to
+// newTransport, e.g. when the Corefile block that configures socket options is only parsed
+// after the proxy's transport already exists. Like the other setters, this must only be
+// called during setup, before the transport starts handling queries.
+func (t *transport) SetDialOpts(opts ...TransportOption) {
+	for _, opt := range opts {
+		opt(&t.dialOpts)
+	}
+}
+
+// SetMaxIdleConns sets the maximum number of idle connections kept across all protocols
+// combined. A value of 0 (the default) means no limit.
+func (t *transport) SetMaxIdleConns(n int) { t.maxIdleConns = n }
+
+// SetMaxIdleConnsPerProto sets the maximum number of idle connections kept per protocol
+// (udp, tcp, tcp-tls). A value of 0 (the default) means no limit.
+func (t *transport) SetMaxIdleConnsPerProto(n int) { t.maxIdleConnsPerProto = n }
+
+// SetDialCoalesce enables or disables collapsing concurrent Dial calls for the same proto,
+// on an empty pool, into a single dial. Disabled by default.
+func (t *transport) SetDialCoalesce(on bool) { t.dialCoalesce = on }
+
+// CoalesceHits reports how many Dial calls rode on another goroutine's in-flight dial
+// instead of opening their own connection.
+func (t *transport) CoalesceHits() uint64 { return atomic.LoadUint64(&t.coalesceHits) }
+
+// SetDialBackoff sets the base and cap durations used to compute the exponential backoff
+// delay applied to a proto after consecutive dial failures.
+func (t *transport) SetDialBackoff(base, cap time.Duration) {
+	t.backoffBase = base
+	t.backoffCap = cap
+}
+
+// DialBackoffSkipped reports how many Dial calls were skipped outright because their proto
+// was in its backoff cool-down period.
+func (t *transport) DialBackoffSkipped() uint64 { return atomic.LoadUint64(&t.backoffSkipped) }
+
+// SetProbe sets the health-probe run against a cached connection before it is handed out by
+// Dial, once it is older than the probe_after threshold (see SetProbeAfter). A nil probe (the
+// default) disables probing, matching the previous optimistic behavior.
+func (t *transport) SetProbe(probe func(*dns.Conn) error) { t.probe = probe }
+
+// SetProbeAfter sets the probe_after threshold: a cached connection older than d (but still
+// younger than expire) is probed before reuse. Defaults to defaultProbeAfter.
+func (t *transport) SetProbeAfter(d time.Duration) { t.probeAfter = d }
+
+// errProbeUnexpectedData is returned by DefaultProbe when a conn that should be idle has
+// data waiting to be read, e.g. a stray response or a protocol error from a prior exchange.
+var errProbeUnexpectedData = errors.New("forward: unexpected data on idle connection")
+
+// DefaultProbe is a ready-to-use probe for SetProbe. It puts an already-elapsed read
+// deadline on the underlying socket and attempts a 1-byte read: a timeout error means the
+// socket is alive with nothing to read (healthy), while io.EOF or a reset means the peer
+// closed it out from under us. This mirrors how net/http validates a pooled conn before
+// reuse, and works for both plain and TLS-wrapped connections.
+func DefaultProbe(c *dns.Conn) error {
+	conn := c.Conn
+	if err := conn.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+		return err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if err == nil {
+		return errProbeUnexpectedData
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	return err
+}
+
+const (
+	defaultExpire = 10 * time.Second
+
+	defaultBackoffBase = 500 * time.Millisecond
+	defaultBackoffCap  = 60 * time.Second
+	dialCoolDownDelay  = 5 * time.Minute
+
+	defaultProbeAfter = 5 * time.Second
+)
@@ -0,0 +1,188 @@
+package forward
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// drainManager forces the caller to wait for connManager to finish processing everything sent to
+// it so far: connManager only returns to its select loop once the current case's body has
+// run to completion, so a backoffCheck round trip (which touches none of the idle lists)
+// is a safe way to synchronize with it before inspecting t.conns directly.
+func drainManager(t *transport) { t.backoffAllowed("sync-barrier") }
+
+func TestMaxIdleConnsPerProtoEvictsOldest(t *testing.T) {
+	tr := newTransport("", nil)
+	defer tr.Stop()
+	tr.SetMaxIdleConnsPerProto(2)
+
+	var closed int32
+	newConn := func() *dns.Conn {
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return &dns.Conn{Conn: &recordingConn{Conn: c1, closed: &closed}}
+	}
+
+	tr.Yield(newConn())
+	tr.Yield(newConn())
+	tr.Yield(newConn())
+	drainManager(tr)
+
+	if n := tr.conns["tcp"].Len(); n != 2 {
+		t.Errorf("expected 2 idle tcp conns after the per-proto cap evicted the oldest, got %d", n)
+	}
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Errorf("expected exactly 1 conn closed by eviction, got %d", closed)
+	}
+}
+
+func TestMaxIdleConnsEvictsGlobally(t *testing.T) {
+	tr := newTransport("", nil)
+	defer tr.Stop()
+	tr.SetMaxIdleConns(1)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tr.Yield(&dns.Conn{Conn: c1})
+
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	tr.Yield(&dns.Conn{Conn: c3})
+	drainManager(tr)
+
+	if n := tr.idleLen(); n != 1 {
+		t.Errorf("expected 1 idle conn after the global cap evicted the rest, got %d", n)
+	}
+}
+
+func TestDialCoalesce(t *testing.T) {
+	var delayed int32
+	slow := func(network, address string, c syscall.RawConn) error {
+		atomic.AddInt32(&delayed, 1)
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+
+	tr := newTransport("127.0.0.1:0", nil, WithControl(slow))
+	defer tr.Stop()
+	tr.SetDialCoalesce(true)
+
+	var wg sync.WaitGroup
+	const n = 5
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			tr.Dial("tcp")
+		}()
+	}
+	wg.Wait()
+
+	if hits := tr.CoalesceHits(); hits == 0 {
+		t.Error("expected at least one Dial call to have coalesced onto an in-flight dial, got 0")
+	}
+}
+
+func TestDialBackoffSkipsDuringCooldown(t *testing.T) {
+	tr := newTransport("", nil)
+	defer tr.Stop()
+	tr.SetDialBackoff(time.Minute, time.Minute)
+
+	if _, _, err := tr.Dial("tcp"); err == nil {
+		t.Fatal("expected the first dial against an empty address to fail")
+	}
+
+	if _, _, err := tr.Dial("tcp"); err != errDialBackoff {
+		t.Fatalf("expected errDialBackoff while tcp is in cool-down, got %v", err)
+	}
+
+	if skipped := tr.DialBackoffSkipped(); skipped == 0 {
+		t.Error("expected DialBackoffSkipped to be > 0, got 0")
+	}
+}
+
+func TestFromCacheSkipsConnsThatFailTheirProbe(t *testing.T) {
+	tr := newTransport("", nil)
+	defer tr.Stop()
+	tr.SetProbeAfter(0)
+	tr.SetProbe(func(c *dns.Conn) error { return errors.New("forced probe failure") })
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tr.Yield(&dns.Conn{Conn: c1})
+
+	if c := tr.fromCache("tcp"); c != nil {
+		t.Error("expected fromCache to report a miss after the only cached conn failed its probe")
+	}
+}
+
+func TestFromCacheScansPastAFailedProbe(t *testing.T) {
+	tr := newTransport("", nil)
+	defer tr.Stop()
+	tr.SetProbeAfter(0)
+
+	bad1, bad2 := net.Pipe()
+	defer bad2.Close()
+	good1, good2 := net.Pipe()
+	defer good1.Close()
+	defer good2.Close()
+
+	tr.SetProbe(func(c *dns.Conn) error {
+		if c.Conn == bad1 {
+			return errors.New("forced probe failure")
+		}
+		return nil
+	})
+
+	// good is yielded first (and so sits behind bad, the MRU entry) to make sure fromCache
+	// keeps scanning instead of stopping at the first failure.
+	tr.Yield(&dns.Conn{Conn: good1})
+	tr.Yield(&dns.Conn{Conn: bad1})
+
+	c := tr.fromCache("tcp")
+	if c == nil {
+		t.Fatal("expected fromCache to fall through to the healthy conn behind the failed one")
+	}
+	if c.Conn != good1 {
+		t.Error("expected fromCache to return the healthy conn, not a fresh miss")
+	}
+}
+
+func TestDefaultProbeDetectsClosedPeer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	c2.Close()
+
+	if err := DefaultProbe(&dns.Conn{Conn: c1}); err == nil {
+		t.Error("expected DefaultProbe to report the closed peer as unhealthy")
+	}
+}
+
+func TestDefaultProbeAllowsHealthyConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	if err := DefaultProbe(&dns.Conn{Conn: c1}); err != nil {
+		t.Errorf("expected DefaultProbe to report a healthy idle conn as usable, got %v", err)
+	}
+}
+
+// recordingConn wraps a net.Conn and counts how many times Close is called, so tests can
+// verify eviction closed exactly the connections it should have.
+type recordingConn struct {
+	net.Conn
+	closed *int32
+}
+
+func (c *recordingConn) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return c.Conn.Close()
+}
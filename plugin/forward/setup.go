@@ -0,0 +1,206 @@
+package forward
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// Setup parses a forward Corefile stanza into a Forward, e.g.:
+//
+//	forward . 9.9.9.9 1.1.1.1 {
+//	    max_idle_conns 200 50
+//	    health_check 5s
+//	    socket_opts {
+//	        reuseport
+//	        keepalive 30s
+//	    }
+//	}
+func Setup(c *caddy.Controller) (*Forward, error) {
+	var f *Forward
+	i := 0
+	for c.Next() {
+		if i > 0 {
+			return nil, c.Errf("forward: can only be specified once per server block")
+		}
+		i++
+
+		fwd, err := parseStanza(c)
+		if err != nil {
+			return nil, err
+		}
+		f = fwd
+	}
+	return f, nil
+}
+
+// parseStanza parses a single forward stanza: the plugin name, the zone it's responsible
+// for, the upstream addresses to build a transport for, and any directives in the block
+// that follows.
+func parseStanza(c *caddy.Controller) (*Forward, error) {
+	f := New()
+
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	f.from = c.Val()
+
+	to := c.RemainingArgs()
+	if len(to) == 0 {
+		return nil, c.ArgErr()
+	}
+	for _, host := range to {
+		f.proxies = append(f.proxies, newTransport(host, f.tlsConfig))
+	}
+
+	for c.NextBlock() {
+		if err := parseBlock(c, f); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// parseBlock dispatches a single directive from a forward stanza's block to every proxy
+// transport it applies to.
+func parseBlock(c *caddy.Controller, f *Forward) error {
+	switch c.Val() {
+	case "max_idle_conns":
+		// parseMaxIdleConns reads its args off the shared controller, so it can only run
+		// once per directive; apply the result to every other proxy instead of re-parsing.
+		if err := parseMaxIdleConns(c, f.proxies[0]); err != nil {
+			return err
+		}
+		for _, t := range f.proxies[1:] {
+			t.maxIdleConns = f.proxies[0].maxIdleConns
+			t.maxIdleConnsPerProto = f.proxies[0].maxIdleConnsPerProto
+		}
+
+	case "socket_opts":
+		opts, err := parseSocketOpts(c)
+		if err != nil {
+			return err
+		}
+		for _, t := range f.proxies {
+			t.SetDialOpts(opts...)
+		}
+
+	case "health_check":
+		// Same as max_idle_conns above: parse once, then apply to the rest.
+		if err := parseHealthCheck(c, f.proxies[0]); err != nil {
+			return err
+		}
+		for _, t := range f.proxies[1:] {
+			t.probeAfter = f.proxies[0].probeAfter
+			t.probe = f.proxies[0].probe
+		}
+
+	default:
+		return c.Errf("forward: unknown property '%s'", c.Val())
+	}
+
+	return nil
+}
+
+// parseMaxIdleConns parses the max_idle_conns directive and applies it to t.
+//
+//	max_idle_conns <total> [<per-proto>]
+//
+// <total> caps the number of idle connections kept across all protocols; the optional
+// <per-proto> caps how many of those may belong to a single proto bucket (udp, tcp,
+// tcp-tls).
+func parseMaxIdleConns(c *caddy.Controller, t *transport) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+
+	total, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("max_idle_conns: %v", err)
+	}
+	t.SetMaxIdleConns(total)
+
+	if len(args) == 2 {
+		perProto, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("max_idle_conns: %v", err)
+		}
+		t.SetMaxIdleConnsPerProto(perProto)
+	}
+
+	return nil
+}
+
+// parseSocketOpts parses a socket_opts block and returns the TransportOptions it
+// describes, for the caller to apply to each proxy's transport via SetDialOpts.
+//
+//	socket_opts {
+//	    reuseport
+//	    keepalive <duration>
+//	    mark <mark>
+//	}
+func parseSocketOpts(c *caddy.Controller) ([]TransportOption, error) {
+	var opts []TransportOption
+
+	// The stanza's own block is already open, so walk this nested block by hand up to its
+	// closing brace rather than through NextBlock.
+	if !c.NextArg() || c.Val() != "{" {
+		return nil, c.ArgErr()
+	}
+	for c.Next() && c.Val() != "}" {
+		switch c.Val() {
+		case "reuseport":
+			opts = append(opts, WithReusePort())
+
+		case "keepalive":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			dur, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return nil, fmt.Errorf("socket_opts: keepalive: %v", err)
+			}
+			opts = append(opts, WithKeepAlive(dur))
+
+		case "mark":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			mark, err := strconv.ParseInt(c.Val(), 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("socket_opts: mark: %v", err)
+			}
+			opts = append(opts, WithSocketMark(int(mark)))
+
+		default:
+			return nil, c.Errf("forward: unknown socket_opts property '%s'", c.Val())
+		}
+	}
+
+	return opts, nil
+}
+
+// parseHealthCheck parses the health_check directive and applies it to t.
+//
+//	health_check <probe_after>
+//
+// <probe_after> is how long a cached connection may sit idle before Dial probes it with
+// DefaultProbe rather than handing it out untested.
+func parseHealthCheck(c *caddy.Controller, t *transport) error {
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	dur, err := time.ParseDuration(c.Val())
+	if err != nil {
+		return fmt.Errorf("health_check: %v", err)
+	}
+
+	t.SetProbeAfter(dur)
+	t.SetProbe(DefaultProbe)
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package forward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestSetupMaxIdleConns(t *testing.T) {
+	c := caddy.NewTestController("dns", `forward . 9.9.9.9 {
+		max_idle_conns 200 50
+	}`)
+
+	f, err := Setup(c)
+	if err != nil {
+		t.Fatalf("Setup returned an error: %v", err)
+	}
+	if len(f.proxies) != 1 {
+		t.Fatalf("expected 1 proxy, got %d", len(f.proxies))
+	}
+
+	tr := f.proxies[0]
+	if tr.maxIdleConns != 200 {
+		t.Errorf("expected maxIdleConns 200, got %d", tr.maxIdleConns)
+	}
+	if tr.maxIdleConnsPerProto != 50 {
+		t.Errorf("expected maxIdleConnsPerProto 50, got %d", tr.maxIdleConnsPerProto)
+	}
+}
+
+func TestSetupMaxIdleConnsAppliesToEveryUpstream(t *testing.T) {
+	c := caddy.NewTestController("dns", `forward . 9.9.9.9 1.1.1.1 {
+		max_idle_conns 10
+	}`)
+
+	f, err := Setup(c)
+	if err != nil {
+		t.Fatalf("Setup returned an error: %v", err)
+	}
+	if len(f.proxies) != 2 {
+		t.Fatalf("expected 2 proxies, got %d", len(f.proxies))
+	}
+	for i, tr := range f.proxies {
+		if tr.maxIdleConns != 10 {
+			t.Errorf("proxy %d: expected maxIdleConns 10, got %d", i, tr.maxIdleConns)
+		}
+	}
+}
+
+func TestParseMaxIdleConnsErrors(t *testing.T) {
+	tests := []string{
+		`forward . 9.9.9.9 { max_idle_conns }`,
+		`forward . 9.9.9.9 { max_idle_conns 1 2 3 }`,
+		`forward . 9.9.9.9 { max_idle_conns nope }`,
+		`forward . 9.9.9.9 { max_idle_conns 200 nope }`,
+	}
+	for _, input := range tests {
+		c := caddy.NewTestController("dns", input)
+		if _, err := Setup(c); err == nil {
+			t.Errorf("expected an error for input %q, got nil", input)
+		}
+	}
+}
+
+func TestSetupSocketOpts(t *testing.T) {
+	c := caddy.NewTestController("dns", `forward . 9.9.9.9 {
+		socket_opts {
+			keepalive 30s
+			reuseport
+		}
+	}`)
+
+	f, err := Setup(c)
+	if err != nil {
+		t.Fatalf("Setup returned an error: %v", err)
+	}
+
+	tr := f.proxies[0]
+	if tr.dialOpts.keepAlive != 30*time.Second {
+		t.Errorf("expected keepAlive 30s, got %s", tr.dialOpts.keepAlive)
+	}
+	if tr.dialOpts.control == nil {
+		t.Error("expected reuseport to set a control function, got nil")
+	}
+}
+
+func TestParseSocketOptsUnknownProperty(t *testing.T) {
+	c := caddy.NewTestController("dns", `forward . 9.9.9.9 {
+		socket_opts {
+			bogus
+		}
+	}`)
+
+	if _, err := Setup(c); err == nil {
+		t.Error("expected an error for an unknown socket_opts property, got nil")
+	}
+}
+
+func TestSetupHealthCheck(t *testing.T) {
+	c := caddy.NewTestController("dns", `forward . 9.9.9.9 {
+		health_check 5s
+	}`)
+
+	f, err := Setup(c)
+	if err != nil {
+		t.Fatalf("Setup returned an error: %v", err)
+	}
+
+	tr := f.proxies[0]
+	if tr.probeAfter != 5*time.Second {
+		t.Errorf("expected probeAfter 5s, got %s", tr.probeAfter)
+	}
+	if tr.probe == nil {
+		t.Error("expected health_check to install a probe, got nil")
+	}
+}
+
+func TestParseHealthCheckErrors(t *testing.T) {
+	tests := []string{
+		`forward . 9.9.9.9 { health_check }`,
+		`forward . 9.9.9.9 { health_check nope }`,
+	}
+	for _, input := range tests {
+		c := caddy.NewTestController("dns", input)
+		if _, err := Setup(c); err == nil {
+			t.Errorf("expected an error for input %q, got nil", input)
+		}
+	}
+}
+
+func TestSetupUnknownProperty(t *testing.T) {
+	c := caddy.NewTestController("dns", `forward . 9.9.9.9 {
+		bogus
+	}`)
+
+	if _, err := Setup(c); err == nil {
+		t.Error("expected an error for an unknown directive, got nil")
+	}
+}
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package forward
+
+import "syscall"
+
+// soMark is SO_MARK. The syscall package doesn't expose it directly since it's
+// Linux-specific, so we use the numeric value from linux/asm-generic/socket.h.
+const soMark = 0x24
+
+// soReusePort is SO_REUSEPORT. Like soMark above, this needs a manual numeric constant:
+// the syscall package only defines it on arm64/mips*/ppc64*/riscv64/s390x/loong64, not on
+// amd64, 386 or arm, which is what CoreDNS actually ships on.
+const soReusePort = 0xf
+
+// reusePortControl sets SO_REUSEPORT on the outbound socket.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// markControl returns a control function that sets SO_MARK to mark on the outbound socket.
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soMark, mark)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+package forward
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// getSockoptInt dials addr with control applied and returns the named getsockopt value read
+// back from the resulting socket.
+func getSockoptInt(t *testing.T, addr string, control func(network, address string, c syscall.RawConn) error, opt int) int {
+	t.Helper()
+
+	d := net.Dialer{Control: control}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("expected *net.TCPConn, got %T", conn)
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+
+	var val int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		val, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); err != nil {
+		t.Fatalf("Control: %v", err)
+	}
+	if serr != nil {
+		t.Fatalf("getsockopt: %v", serr)
+	}
+	return val
+}
+
+func TestReusePortControlSetsSockopt(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go acceptAndClose(ln)
+
+	if val := getSockoptInt(t, ln.Addr().String(), reusePortControl, soReusePort); val == 0 {
+		t.Error("expected SO_REUSEPORT to be set on the dialed socket, got 0")
+	}
+}
+
+func TestMarkControlSetsSockopt(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go acceptAndClose(ln)
+
+	const mark = 42
+	if val := getSockoptInt(t, ln.Addr().String(), markControl(mark), soMark); val != mark {
+		t.Errorf("expected SO_MARK %d on the dialed socket, got %d", mark, val)
+	}
+}
+
+// TestWithReusePortAndSocketMarkDial exercises the TransportOptions end to end, through
+// dialOptions and dial0, rather than calling the control functions directly.
+func TestWithReusePortAndSocketMarkDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go acceptAndClose(ln)
+
+	tr := newTransport(ln.Addr().String(), nil, WithReusePort(), WithSocketMark(7))
+	defer tr.Stop()
+
+	conn, err := tr.dial0("tcp")
+	if err != nil {
+		t.Fatalf("dial0 with WithReusePort/WithSocketMark: %v", err)
+	}
+	defer conn.Close()
+}
+
+func acceptAndClose(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package forward
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errSocketOptionUnsupported is returned by reusePortControl and markControl on platforms
+// that don't support the requested socket option.
+var errSocketOptionUnsupported = errors.New("forward: socket option not supported on this platform")
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errSocketOptionUnsupported
+}
+
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errSocketOptionUnsupported
+	}
+}